@@ -0,0 +1,174 @@
+// Copyright 2013 Joshua Tacoma. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uritemplates
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Partial substitutes the variables present in values and returns a
+// new UriTemplate in which every other variable is left intact as
+// valid template syntax, so it can be Expanded again once the rest of
+// the variables are known. This is useful for API clients that know
+// some variables at construction time (a base URL, a user) and others
+// only at call time (a query): building the client's UriTemplate is a
+// one-time Parse, and each call site supplies the rest via Expand.
+//
+// Resolving only some of the variables in a multi-variable expression
+// rewrites its operator so the result stays valid: {?a,b,c} with only
+// a supplied becomes "?a=1{&b,c}", since the "?" operator only
+// applies to the first variable actually present and "&" to the rest;
+// {/x,y} with only x supplied becomes "/xval{/y}", since "/" already
+// applies the same way to every variable in the expression. Within a
+// single expression, Partial requires the resolved variables to
+// precede the unresolved ones (the order they're declared in the
+// template), since an expression can't otherwise be split back into
+// valid template syntax.
+func (self *UriTemplate) Partial(values map[string]interface{}) (*UriTemplate, error) {
+	var buf bytes.Buffer
+	for _, p := range self.parts {
+		if len(p.terms) == 0 {
+			buf.WriteString(p.raw)
+			continue
+		}
+		resolved, unresolved := 0, 0
+		for _, t := range p.terms {
+			if _, ok := values[t.name]; ok {
+				resolved++
+			} else {
+				unresolved++
+			}
+		}
+		switch {
+		case unresolved == 0:
+			if err := p.expandTo(&buf, values); err != nil {
+				return nil, err
+			}
+		case resolved == 0:
+			buf.WriteString(p.serialize())
+		default:
+			prefixLen := 0
+			for prefixLen < len(p.terms) {
+				if _, ok := values[p.terms[prefixLen].name]; !ok {
+					break
+				}
+				prefixLen++
+			}
+			for _, t := range p.terms[prefixLen:] {
+				if _, ok := values[t.name]; ok {
+					return nil, fmt.Errorf("uritemplates: Partial requires resolved variables to precede unresolved variables within %q", p.serialize())
+				}
+			}
+			resolvedPart := templatePart{
+				terms:         p.terms[:prefixLen],
+				first:         p.first,
+				sep:           p.sep,
+				named:         p.named,
+				ifemp:         p.ifemp,
+				allowReserved: p.allowReserved,
+			}
+			if err := resolvedPart.expandTo(&buf, values); err != nil {
+				return nil, err
+			}
+			buf.WriteString(p.residualSyntax(p.terms[prefixLen:]))
+		}
+	}
+	return Parse(buf.String())
+}
+
+// String reconstructs template syntax for self from its parsed parts,
+// rather than returning the raw text it was originally Parse'd from.
+// It is the same serializer Partial uses to rewrite the residual
+// parts of an expression, so the result is always a valid input to
+// Parse.
+func (self *UriTemplate) String() string {
+	var buf bytes.Buffer
+	for _, p := range self.parts {
+		buf.WriteString(p.serialize())
+	}
+	return buf.String()
+}
+
+// serialize reconstructs this part's template syntax: a literal part
+// returns its raw text unchanged, and an expression part rebuilds
+// "{<operator><term>,<term>,...}" from its parsed operator and terms.
+func (self *templatePart) serialize() string {
+	if len(self.terms) == 0 {
+		return self.raw
+	}
+	names := make([]string, len(self.terms))
+	for i, t := range self.terms {
+		names[i] = t.serialize()
+	}
+	joined := strings.Join(names, ",")
+	if op := self.operatorChar(); op != 0 {
+		return "{" + string(op) + joined + "}"
+	}
+	return "{" + joined + "}"
+}
+
+// serialize reconstructs this term's declaration syntax: its name,
+// followed by "*" if it explodes or ":<n>" if it has a prefix
+// modifier (the two are mutually exclusive, as enforced by parseTerm).
+func (t templateTerm) serialize() string {
+	if t.explode {
+		return t.name + "*"
+	}
+	if t.truncate > 0 {
+		return t.name + ":" + strconv.Itoa(t.truncate)
+	}
+	return t.name
+}
+
+// operatorChar returns the operator character this part was parsed
+// with (one of "+.#;/?&"), or 0 for the simple, no-operator form.
+func (self *templatePart) operatorChar() byte {
+	if self.first != "" {
+		return self.first[0]
+	}
+	if self.allowReserved {
+		return '+'
+	}
+	return 0
+}
+
+// residualSyntax returns the template syntax an expression should
+// wear once some of its leading terms have already been resolved to
+// literal text and only terms is left. It continues the effect of
+// self's operator on whatever literal text Partial wrote before it:
+// for "." "/" ";" the prefix and separator are the same character, so
+// the remaining terms keep using it and that character alone serves
+// as the separator from the literal text that precedes it; "?"
+// switches to "&", its dedicated "rest of the query string" operator,
+// which likewise supplies its own separator. "+" and "#" both join
+// later terms with a bare "," and full reserved-character support,
+// which is exactly what "+" already does, so both continue as "+" -
+// but unlike the operators above, "+" has no prefix character of its
+// own to act as a separator, so (like the plain comma-separated form,
+// which has no operator at all) it needs an explicit literal self.sep
+// before the residual.
+func (self *templatePart) residualSyntax(terms []templateTerm) string {
+	names := make([]string, len(terms))
+	for i, t := range terms {
+		names[i] = t.serialize()
+	}
+	joined := strings.Join(names, ",")
+	switch self.first {
+	case "#":
+		return self.sep + "{+" + joined + "}"
+	case "?", "&":
+		return "{&" + joined + "}"
+	case ".", "/", ";":
+		return "{" + self.first + joined + "}"
+	default:
+		if self.allowReserved {
+			return self.sep + "{+" + joined + "}"
+		}
+		return self.sep + "{" + joined + "}"
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Joshua Tacoma. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uritemplates
+
+import (
+	"testing"
+)
+
+func TestPartial(t *testing.T) {
+	cases := []struct {
+		template string
+		known    map[string]interface{}
+		rest     map[string]interface{}
+		expected string
+	}{
+		{"{?a,b,c}",
+			map[string]interface{}{"a": "1"},
+			map[string]interface{}{"b": "2", "c": "3"},
+			"?a=1&b=2&c=3"},
+		{"{/x,y}",
+			map[string]interface{}{"x": "val"},
+			map[string]interface{}{"y": "other"},
+			"/val/other"},
+		{"X{a,b}",
+			map[string]interface{}{"a": "hi"},
+			map[string]interface{}{"b": "bye"},
+			"Xhi,bye"},
+		{"/repos{/owner,repo}{?q}",
+			map[string]interface{}{"owner": "jtacoma", "repo": "uritemplates"},
+			map[string]interface{}{"q": "sort"},
+			"/repos/jtacoma/uritemplates?q=sort"},
+		{"{+a,b}",
+			map[string]interface{}{"a": "x/y"},
+			map[string]interface{}{"b": "z"},
+			"x/y,z"},
+		{"{#a,b}",
+			map[string]interface{}{"a": "hi"},
+			map[string]interface{}{"b": "by/e"},
+			"#hi,by/e"},
+	}
+	for _, c := range cases {
+		template, err := Parse(c.template)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %s", c.template, err)
+		}
+		partial, err := template.Partial(c.known)
+		if err != nil {
+			t.Fatalf("%q.Partial(%+v) failed: %s", c.template, c.known, err)
+		}
+		result, err := partial.Expand(c.rest)
+		if err != nil {
+			t.Fatalf("%q.Partial(%+v).Expand(%+v) failed: %s", c.template, c.known, c.rest, err)
+		}
+		if result != c.expected {
+			t.Errorf("%q: expected %v, but got %v", c.template, c.expected, result)
+		}
+	}
+}
+
+func TestPartialRequiresPrefixOrder(t *testing.T) {
+	template, _ := Parse("{?a,b,c}")
+	if _, err := template.Partial(map[string]interface{}{"b": "2"}); err == nil {
+		t.Errorf("expected an error when resolving a non-leading variable, but Partial succeeded")
+	}
+}
+
+func TestString(t *testing.T) {
+	templates := []string{
+		"/repos{/owner,repo:3}{?q*}",
+		"X{.x,y}",
+		"{+path}",
+	}
+	for _, raw := range templates {
+		template, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %s", raw, err)
+		}
+		if s := template.String(); s != raw {
+			t.Errorf("expected String() to reproduce %q, but got %q", raw, s)
+		}
+	}
+}
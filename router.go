@@ -0,0 +1,173 @@
+// Copyright 2013 Joshua Tacoma. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uritemplates
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type ctxKey int
+
+// varsKey is the context.Context key under which Router stores the
+// variables it extracted for a request; retrieve it with Vars.
+const varsKey ctxKey = 0
+
+// Router matches incoming *http.Request's against a set of registered
+// UriTemplate's and dispatches to the http.Handler registered for
+// whichever one matches, turning the level-4 RFC 6570 support in this
+// package into a small server-side routing component. Templates like
+// "/repos{/owner,repo}{?q*}" can cover both path and query variables
+// in a single registration; the request's fragment is not matched.
+type Router struct {
+	root             *trieNode
+	notFoundHandler  http.Handler
+	methodNotAllowed http.Handler
+}
+
+type route struct {
+	template *UriTemplate
+	method   string
+	handler  http.Handler
+}
+
+// NewRouter creates an empty Router. Its NotFound and MethodNotAllowed
+// hooks default to http.NotFound and a handler that replies with
+// http.StatusMethodNotAllowed.
+func NewRouter() *Router {
+	return &Router{
+		root:             newTrieNode(),
+		notFoundHandler:  http.HandlerFunc(http.NotFound),
+		methodNotAllowed: http.HandlerFunc(defaultMethodNotAllowed),
+	}
+}
+
+func defaultMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// HandlerFunc registers h to handle any request whose URI matches
+// template, regardless of method.
+func (self *Router) HandlerFunc(template string, h http.Handler) error {
+	return self.Handle("", template, h)
+}
+
+// Handle registers h to handle requests with the given method (or any
+// method, if method is "") whose URI matches template. The template
+// is parsed eagerly, so a malformed template is reported immediately
+// rather than at request time.
+func (self *Router) Handle(method, template string, h http.Handler) error {
+	parsed, err := Parse(template)
+	if err != nil {
+		return err
+	}
+	rt := &route{template: parsed, method: method, handler: h}
+	prefix := template
+	if idx := strings.IndexByte(template, '{'); idx >= 0 {
+		prefix = template[:idx]
+	}
+	self.root.insert(prefix, rt)
+	return nil
+}
+
+// NotFound sets the handler invoked when no registered template
+// matches the request's URI at all.
+func (self *Router) NotFound(h http.Handler) {
+	self.notFoundHandler = h
+}
+
+// MethodNotAllowed sets the handler invoked when a registered
+// template matches the request's URI but none of its registrations
+// accept the request's method.
+func (self *Router) MethodNotAllowed(h http.Handler) {
+	self.methodNotAllowed = h
+}
+
+// ServeHTTP implements http.Handler. It matches r's escaped path and
+// query against every registered template whose static prefix is
+// consistent with r's URI, most-specific-prefix first, and dispatches
+// to the first one whose Unexpand succeeds and whose registered
+// method (if any) matches r.Method. The extracted variables are
+// attached to r's context and retrievable with Vars.
+func (self *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		uri += "?" + r.URL.RawQuery
+	}
+	pathMatched := false
+	for _, rt := range self.root.candidates(uri) {
+		values, err := rt.template.Unexpand(uri)
+		if err != nil {
+			continue
+		}
+		pathMatched = true
+		if rt.method != "" && rt.method != r.Method {
+			continue
+		}
+		ctx := context.WithValue(r.Context(), varsKey, values)
+		rt.handler.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+	if pathMatched {
+		self.methodNotAllowed.ServeHTTP(w, r)
+		return
+	}
+	self.notFoundHandler.ServeHTTP(w, r)
+}
+
+// Vars returns the template variables extracted for r by the Router
+// that dispatched it, or nil if r was not served through a Router.
+func Vars(r *http.Request) map[string]interface{} {
+	values, _ := r.Context().Value(varsKey).(map[string]interface{})
+	return values
+}
+
+// trieNode is a byte trie over templates' static (pre-"{") prefixes,
+// so ServeHTTP only has to try the routes consistent with the request
+// URI it actually walks through rather than every registered route.
+type trieNode struct {
+	children map[byte]*trieNode
+	routes   []*route
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[byte]*trieNode)}
+}
+
+func (self *trieNode) insert(prefix string, rt *route) {
+	node := self
+	for i := 0; i < len(prefix); i++ {
+		b := prefix[i]
+		child, ok := node.children[b]
+		if !ok {
+			child = newTrieNode()
+			node.children[b] = child
+		}
+		node = child
+	}
+	node.routes = append(node.routes, rt)
+}
+
+// candidates returns every route whose static prefix is a prefix of
+// uri, most-specific (longest) prefix first; routes sharing the same
+// prefix are tried in registration order.
+func (self *trieNode) candidates(uri string) []*route {
+	nodes := []*trieNode{self}
+	node := self
+	for i := 0; i < len(uri); i++ {
+		child, ok := node.children[uri[i]]
+		if !ok {
+			break
+		}
+		node = child
+		nodes = append(nodes, node)
+	}
+	var matched []*route
+	for i := len(nodes) - 1; i >= 0; i-- {
+		matched = append(matched, nodes[i].routes...)
+	}
+	return matched
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 Joshua Tacoma. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uritemplates
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	router := NewRouter()
+	err := router.Handle(http.MethodGet, "/repos{/owner,repo}{?q*}", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := Vars(r)
+			w.Write([]byte(vars["owner"].(string) + "/" + vars["repo"].(string)))
+		}))
+	if err != nil {
+		t.Fatalf("Handle failed: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/repos/jtacoma/uritemplates?q=sort", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "jtacoma/uritemplates" {
+		t.Errorf("expected %q, but got %q", "jtacoma/uritemplates", body)
+	}
+}
+
+func TestRouterDispatchAdjacentMultiTermExpressions(t *testing.T) {
+	router := NewRouter()
+	err := router.Handle(http.MethodGet, "/resource{/id}{/sub,action}", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := Vars(r)
+			w.Write([]byte(vars["id"].(string) + "/" + vars["sub"].(string) + "/" + vars["action"].(string)))
+		}))
+	if err != nil {
+		t.Fatalf("Handle failed: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/resource/42/comments/edit", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "42/comments/edit" {
+		t.Errorf("expected %q, but got %q", "42/comments/edit", body)
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	router := NewRouter()
+	router.Handle(http.MethodGet, "/repos{/owner,repo}", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodPost, "/repos/jtacoma/uritemplates", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, but got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestRouterSamePrefixRegistrationOrder(t *testing.T) {
+	router := NewRouter()
+	router.Handle(http.MethodGet, "/foo{/bar}", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("first")) }))
+	router.Handle(http.MethodGet, "/foo{/baz}", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("second")) }))
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/123", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if body := rec.Body.String(); body != "first" {
+		t.Errorf("expected the first-registered route to win, but got %q", body)
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := NewRouter()
+	router.Handle(http.MethodGet, "/repos{/owner,repo}", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/users/jtacoma", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, but got %d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2013 Joshua Tacoma. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uritemplates
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// tagOptions mirrors the tag layout used by encoding/json: a name
+// followed by a comma-separated list of options, e.g.
+// `uritemplate:"repo,explode,omitempty"`.
+type tagOptions struct {
+	name      string
+	explode   bool
+	omitempty bool
+}
+
+func parseTag(field reflect.StructField) (opts tagOptions, skip bool) {
+	opts.name = field.Name
+	tag := field.Tag.Get("uritemplate")
+	if tag == "-" {
+		return opts, true
+	}
+	if tag == "" {
+		return opts, false
+	}
+	parts := strings.Split(tag, ",")
+	if parts[0] != "" {
+		opts.name = parts[0]
+	}
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "explode":
+			opts.explode = true
+		case "omitempty":
+			opts.omitempty = true
+		}
+	}
+	return opts, false
+}
+
+// ExpandStruct binds template variables to the exported fields of v and
+// expands the template, exactly as Expand would given the equivalent
+// map[string]interface{}. Fields are matched by a
+// `uritemplate:"name,explode"` tag (both the name and the options are
+// optional; an "omitempty" option drops fields holding their type's
+// zero value as reported by reflect.Value.IsZero, so unlike json's
+// omitempty it keeps empty non-nil slices and maps and drops zero
+// structs), falling back to the field's own name when no
+// tag is present. v must be a struct or a pointer to one.
+func (self *UriTemplate) ExpandStruct(v interface{}) (result string, err error) {
+	values, err := structToValues(v)
+	if err != nil {
+		return "", err
+	}
+	return self.Expand(values)
+}
+
+// UnexpandStruct matches uri against the template, as Unexpand would,
+// and stores the extracted variables into the exported fields of v
+// using the same `uritemplate` tag convention as ExpandStruct. v must
+// be a non-nil pointer to a struct.
+func (self *UriTemplate) UnexpandStruct(uri string, v interface{}) (err error) {
+	values, err := self.Unexpand(uri)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("uritemplates: UnexpandStruct requires a non-nil pointer to a struct")
+	}
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Struct {
+		return errors.New("uritemplates: UnexpandStruct requires a pointer to a struct")
+	}
+	return valuesToStruct(values, rv)
+}
+
+// structToValues walks v, which must be a struct or a pointer to one,
+// and produces the map[string]interface{} that ExpandStruct passes to
+// Expand. Scalars become strings, slices and arrays become
+// []interface{}, and maps and nested structs become
+// map[string]interface{}, so the result can flow through the existing
+// expandString/expandArray/expandMap paths unchanged.
+func structToValues(v interface{}) (map[string]interface{}, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("uritemplates: ExpandStruct requires a non-nil struct or pointer")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.New("uritemplates: ExpandStruct requires a struct or pointer to a struct")
+	}
+	values := make(map[string]interface{})
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		opts, skip := parseTag(field)
+		if skip {
+			continue
+		}
+		fv := rv.Field(i)
+		if opts.omitempty && fv.IsZero() {
+			continue
+		}
+		converted, err := fieldToValue(fv)
+		if err != nil {
+			return nil, err
+		}
+		if converted == nil {
+			continue
+		}
+		values[opts.name] = converted
+	}
+	return values, nil
+}
+
+func fieldToValue(fv reflect.Value) (interface{}, error) {
+	for fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return nil, nil
+		}
+		fv = fv.Elem()
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		return fv.String(), nil
+	case reflect.Bool:
+		return fmt.Sprintf("%v", fv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprintf("%v", fv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprintf("%v", fv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("%v", fv.Float()), nil
+	case reflect.Slice, reflect.Array:
+		out := make([]interface{}, fv.Len())
+		for i := range out {
+			elem, err := fieldToValue(fv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = elem
+		}
+		return out, nil
+	case reflect.Map:
+		out := make(map[string]interface{})
+		for _, key := range fv.MapKeys() {
+			elem, err := fieldToValue(fv.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			out[fmt.Sprintf("%v", key.Interface())] = elem
+		}
+		return out, nil
+	case reflect.Struct:
+		nested, err := structToValues(fv.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return nested, nil
+	case reflect.Invalid:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("uritemplates: unsupported field kind %s", fv.Kind())
+	}
+}
+
+// valuesToStruct is the inverse of structToValues: it takes the
+// map[string]interface{} produced by Unexpand and sets the matching
+// exported fields of rv, which must already be a settable struct value.
+func valuesToStruct(values map[string]interface{}, rv reflect.Value) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		opts, skip := parseTag(field)
+		if skip {
+			continue
+		}
+		raw, exists := values[opts.name]
+		if !exists {
+			continue
+		}
+		if err := assignValue(rv.Field(i), raw); err != nil {
+			return fmt.Errorf("uritemplates: field %s: %s", field.Name, err)
+		}
+	}
+	return nil
+}
+
+func assignValue(fv reflect.Value, raw interface{}) error {
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		return assignValue(fv.Elem(), raw)
+	}
+	switch v := raw.(type) {
+	case string:
+		return assignString(fv, v)
+	case []string:
+		if fv.Kind() != reflect.Slice {
+			return fmt.Errorf("cannot assign list to %s", fv.Kind())
+		}
+		out := reflect.MakeSlice(fv.Type(), len(v), len(v))
+		for i, s := range v {
+			if err := assignString(out.Index(i), s); err != nil {
+				return err
+			}
+		}
+		fv.Set(out)
+		return nil
+	case map[string]string:
+		if fv.Kind() != reflect.Map {
+			return fmt.Errorf("cannot assign map to %s", fv.Kind())
+		}
+		out := reflect.MakeMap(fv.Type())
+		for k, s := range v {
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := assignString(elem, s); err != nil {
+				return err
+			}
+			out.SetMapIndex(reflect.ValueOf(k), elem)
+		}
+		fv.Set(out)
+		return nil
+	default:
+		return fmt.Errorf("unsupported extracted value type %T", raw)
+	}
+}
+
+func assignString(fv reflect.Value, s string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		fv.SetBool(s == "true")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if _, err := fmt.Sscanf(s, "%d", &n); err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if _, err := fmt.Sscanf(s, "%d", &n); err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		var n float64
+		if _, err := fmt.Sscanf(s, "%g", &n); err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	default:
+		return fmt.Errorf("cannot assign string to %s", fv.Kind())
+	}
+	return nil
+}
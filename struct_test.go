@@ -0,0 +1,45 @@
+// Copyright 2013 Joshua Tacoma. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uritemplates
+
+import (
+	"testing"
+)
+
+type repoRef struct {
+	User string `uritemplate:"user"`
+	Repo string `uritemplate:"repo"`
+	Ref  string `uritemplate:"ref,omitempty"`
+}
+
+func TestExpandStruct(t *testing.T) {
+	template, err := Parse("/repos{/user,repo}{?ref}")
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	result, err := template.ExpandStruct(&repoRef{User: "jtacoma", Repo: "uritemplates"})
+	if err != nil {
+		t.Fatalf("ExpandStruct failed: %s", err)
+	}
+	expected := "/repos/jtacoma/uritemplates"
+	if result != expected {
+		t.Errorf("expected %v, but got %v", expected, result)
+	}
+}
+
+func TestUnexpandStruct(t *testing.T) {
+	template, err := Parse("/repos{/user,repo}")
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	var out repoRef
+	err = template.UnexpandStruct("/repos/jtacoma/uritemplates", &out)
+	if err != nil {
+		t.Fatalf("UnexpandStruct failed: %s", err)
+	}
+	if out.User != "jtacoma" || out.Repo != "uritemplates" {
+		t.Errorf("expected {jtacoma uritemplates}, but got %+v", out)
+	}
+}
@@ -14,32 +14,34 @@
 //	values["repo"] = "uritemplates"
 //	expanded, _ := template.ExpandString(values)
 //	fmt.Printf(expanded)
-//
 package uritemplates
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
-	"net/url"
+	"sync"
 )
 
 var (
-	ALPHA = "a-zA_Z"
-	DIGIT = "0-9"
-	GEN_DELIMS = ":/?#[\\]@"
-	SUB_DELIMS = "!$&'()*+,;="
-	UNRESERVED = ALPHA + DIGIT + "\\-._~"
-	RESERVED = GEN_DELIMS + SUB_DELIMS
+	ALPHA         = "a-zA_Z"
+	DIGIT         = "0-9"
+	GEN_DELIMS    = ":/?#[\\]@"
+	SUB_DELIMS    = "!$&'()*+,;="
+	UNRESERVED    = ALPHA + DIGIT + "\\-._~"
+	RESERVED      = GEN_DELIMS + SUB_DELIMS
 	UNRESERVED_RE = "(?:[" + UNRESERVED + "]|%[0-9A-Fa-f][0-9A-Fa-f])"
-	RESERVED_RE = "(?:[" + UNRESERVED + RESERVED + "]|%[0-9A-Fa-f][0-9A-Fa-f])"
+	RESERVED_RE   = "(?:[" + UNRESERVED + RESERVED + "]|%[0-9A-Fa-f][0-9A-Fa-f])"
 
 	nonUnreserved = regexp.MustCompile("[^A-Za-z0-9\\-._~]")
 	nonReserved   = regexp.MustCompile("[^A-Za-z0-9\\-._~:/?#[\\]@!$&'()*+,;=]")
-	validname  = regexp.MustCompile("^([A-Za-z0-9_\\.]|%[0-9A-Fa-f][0-9A-Fa-f])+$")
-	hex        = []byte("0123456789ABCDEF")
+	validname     = regexp.MustCompile("^([A-Za-z0-9_\\.]|%[0-9A-Fa-f][0-9A-Fa-f])+$")
+	hex           = []byte("0123456789ABCDEF")
 )
 
 func pctEncode(src []byte) []byte {
@@ -119,6 +121,7 @@ type templatePart struct {
 	named         bool
 	ifemp         string
 	allowReserved bool
+	charsetRE     *regexp.Regexp
 }
 
 type templateTerm struct {
@@ -174,9 +177,25 @@ func parseExpression(expression string) (result templatePart, err error) {
 			break
 		}
 	}
+	result.charsetRE = regexp.MustCompile("^(?:" + result.charsetPattern() + ")*$")
 	return result, err
 }
 
+// charsetPattern returns the regexp alternation that a single
+// expanded value must match under this part's operator: the reserved
+// class for +/# (which may contain "/"), the unreserved class with
+// "." excluded for the "." operator (since "." is the separator), and
+// the plain unreserved class otherwise.
+func (self *templatePart) charsetPattern() string {
+	if self.allowReserved {
+		return RESERVED_RE
+	}
+	if self.sep == "." {
+		return strings.Replace(UNRESERVED_RE, ".", "", 1)
+	}
+	return UNRESERVED_RE
+}
+
 func parseTerm(term string) (result templateTerm, err error) {
 	if strings.HasSuffix(term, "*") {
 		result.explode = true
@@ -202,17 +221,45 @@ func parseTerm(term string) (result templateTerm, err error) {
 	return result, err
 }
 
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
 // Expand expands a URI template with a set of values to produce a string.
 func (self *UriTemplate) Expand(values map[string]interface{}) (result string, err error) {
-	var next string
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(buf)
+	buf.Reset()
 	for _, p := range self.parts {
-		next, err = p.expand(values)
-		if err != nil {
-			break
+		if err = p.expandTo(buf, values); err != nil {
+			return "", err
 		}
-		result += next
 	}
-	return result, err
+	return buf.String(), nil
+}
+
+// ExpandString is an alias for Expand.
+func (self *UriTemplate) ExpandString(values map[string]interface{}) (result string, err error) {
+	return self.Expand(values)
+}
+
+// ExpandTo expands a URI template with a set of values and writes the
+// result to w, returning the number of bytes written. Like Expand, it
+// builds the result in a pooled *bytes.Buffer rather than with
+// repeated string concatenation, which matters for templates with many
+// exploded values, such as a {?q*} with hundreds of query parameters;
+// the finished result is then passed to w in a single Write.
+func (self *UriTemplate) ExpandTo(w io.Writer, values map[string]interface{}) (written int64, err error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(buf)
+	buf.Reset()
+	for _, p := range self.parts {
+		if err = p.expandTo(buf, values); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
 }
 
 func unescapeArr(escaped []string) (unescaped []string) {
@@ -223,129 +270,335 @@ func unescapeArr(escaped []string) (unescaped []string) {
 	return unescaped
 }
 
+// Unexpand reconstructs the variable values that, when passed to
+// Expand, would have produced uri. It walks the template's literal and
+// expression parts left to right: literal parts must match uri
+// exactly, and each expression part claims the run of uri up to
+// whatever comes next (the following literal, or the distinguishing
+// prefix of the expression after that) and parses it according to its
+// operator's rules. It returns an error when uri does not match the
+// template, and for the ambiguities found within one expression (a
+// non-exploded named term given twice, more than one exploded term).
+// Where the boundary text after an expression occurs more than once,
+// the split at its last occurrence is taken and no error is reported:
+// "{a}.{b}" against "x.y.z" yields a="x.y" and b="z".
+//
+// Adjacent expressions that share the same operator (e.g. the two
+// "/" expressions in "/repos{/owner}{/repo,ref}") expand to text with
+// no marker at all between them -- the boundary text a later
+// expression's prefix would otherwise supply is indistinguishable
+// from that operator's own separator. mergedRun folds such a run into
+// a single logical expression, whose declared term count is then used
+// to split its tokens correctly, rather than guessing a text boundary
+// that may not exist.
 func (self *UriTemplate) Unexpand(uri string) (result map[string]interface{}, err error) {
-	restr := "^"
-	fmt.Printf("Unexpanding template: %+v", self.parts)
-	for _, p := range self.parts {
-		restr += p.buildRegexp()
-	}
-	restr += "$"
-	fmt.Printf("regexp: %s\n", restr)
-	matches, err := regexp.MatchString(restr, uri)
-	if (!matches) {
-		return nil, errors.New("No match")
-	}
-	pieces := regexp.MustCompile(restr).FindStringSubmatch(uri)[1:]
-	index := 0
-	fmt.Printf("%d, %+v\n", len(pieces), pieces)
 	out := make(map[string]interface{})
-	for _, p := range self.parts {
-		if p.raw != "" || (p.raw == "" && len(p.terms) == 0) {
+	remaining := uri
+	for i := 0; i < len(self.parts); {
+		p := self.parts[i]
+		if len(p.terms) == 0 {
+			if !strings.HasPrefix(remaining, p.raw) {
+				return nil, fmt.Errorf("uritemplates: expected %q, found %q", p.raw, remaining)
+			}
+			remaining = remaining[len(p.raw):]
+			i++
 			continue
 		}
-		for _, t := range p.terms {
-			// +, #, /, .
-			if p.allowReserved || (p.sep == "/" || p.sep == "." || p.sep == ",") {
-				value := pieces[index]
-				if value != "" && t.explode {
-					out[t.name] = unescapeArr(strings.Split(value, p.sep))
-				} else {
-					out[t.name] = value
-				}
-			} else if p.sep == ";" || p.sep == "&" {
-				if t.explode {
-					hash := make(map[string]string)
-					for _, v := range strings.Split(pieces[index], p.sep) {
-						kv := strings.Split(v, "=")
-						if len(kv) == 2 {
-							hash[kv[0]], _ = url.QueryUnescape(kv[1])
-						} else {
-							hash[kv[0]] = ""
-						}
-					}
-					out[t.name] = hash
-				} else {
-					nv := strings.Split(pieces[index], "=")
-					if len(nv) == 2 {
-						out[nv[0]] = nv[1]
-					} else {
-						out[nv[0]] = ""
-					}
-				}
+		merged, last := self.mergedRun(i)
+		segment := remaining
+		if boundary := self.boundaryAfter(last); boundary != "" {
+			// Reserved-allowing operators (+, #) may expand to a value
+			// that itself contains the next expression's boundary text
+			// (e.g. "/a.b/c" before "{.ext}"), so the first occurrence
+			// of that text is not necessarily where this expression's
+			// claim on the uri actually ends. The last occurrence is:
+			// anything the boundary's own operator could stand for
+			// (",", the next literal, ...) cannot itself contain the
+			// boundary, so greedily claiming up to the final match
+			// recovers the split Expand produced.
+			idx := strings.LastIndex(remaining, boundary)
+			if idx < 0 {
+				return nil, fmt.Errorf("uritemplates: %q not found in %q", boundary, remaining)
 			}
-			index ++
+			segment = remaining[:idx]
+			remaining = remaining[idx:]
+		} else {
+			remaining = ""
 		}
+		if err = merged.unexpand(segment, out); err != nil {
+			return nil, err
+		}
+		i = last + 1
+	}
+	if remaining != "" {
+		return nil, fmt.Errorf("uritemplates: unexpected trailing input %q", remaining)
 	}
 	return out, nil
 }
 
-func (self *templatePart) expand(values map[string]interface{}) (result string, err error) {
+// mergedRun returns a templatePart standing in for the whole run of
+// expression parts starting at i that share p's operator (first, sep,
+// named and allowReserved all equal) and have nothing but an empty
+// literal between them, along with the index of the last part folded
+// in. Such a run is what Expand actually produces as one undivided
+// stretch of text, since a later expression's prefix is then the same
+// text as the earlier one's separator; folding them into a single
+// part with the concatenated term list lets unexpandPositional and
+// unexpandNamed split that text by the real number of declared terms
+// instead of by a text boundary that doesn't exist. A run of one
+// returns p itself unchanged.
+func (self *UriTemplate) mergedRun(i int) (merged templatePart, last int) {
+	p := self.parts[i]
+	merged = p
+	last = i
+	for last+2 < len(self.parts) {
+		lit := self.parts[last+1]
+		next := self.parts[last+2]
+		if lit.raw != "" || len(next.terms) == 0 {
+			break
+		}
+		if next.first != p.first || next.sep != p.sep || next.named != p.named || next.allowReserved != p.allowReserved {
+			break
+		}
+		merged.terms = append(append([]templateTerm(nil), merged.terms...), next.terms...)
+		last += 2
+	}
+	return merged, last
+}
+
+// boundaryAfter returns the literal text that ends the expression
+// part at index i, so Unexpand knows where that expression's claim on
+// the uri stops. It is ordinarily the very next part's raw text, but
+// when two expressions are adjacent with nothing literal between them
+// (raw == ""), it falls back to the following expression's own
+// operator prefix (".", "/", ";", "?", "&" or "#"). That text can also
+// occur inside an expanded value (the "." in "a.b", or a "/" in a "+"
+// value), which is why Unexpand splits at its last occurrence in the
+// uri rather than its first. Returns "" when no
+// such boundary exists, meaning the expression consumes the rest of
+// the uri.
+func (self *UriTemplate) boundaryAfter(i int) string {
+	for j := i + 1; j < len(self.parts); j++ {
+		p := self.parts[j]
+		if len(p.terms) == 0 {
+			if p.raw != "" {
+				return p.raw
+			}
+			continue
+		}
+		if p.first != "" {
+			return p.first
+		}
+	}
+	return ""
+}
+
+// expandTo writes this part's contribution to a template expansion
+// into buf. Everything is appended with bytes.Buffer.WriteString,
+// which amortizes to linear time even across many exploded values,
+// instead of the repeated string concatenation (O(n^2) on total
+// output length) that an earlier version of this method used.
+func (self *templatePart) expandTo(buf *bytes.Buffer, values map[string]interface{}) (err error) {
 	if len(self.raw) > 0 {
-		return self.raw, err
+		buf.WriteString(self.raw)
+		return nil
 	}
-	result = self.first
+	start := buf.Len()
+	buf.WriteString(self.first)
 	for _, term := range self.terms {
 		value, exists := values[term.name]
 		if !exists {
 			continue
 		}
-		var next string
-		switch value.(type) {
+		if buf.Len() != start+len(self.first) {
+			buf.WriteString(self.sep)
+		}
+		switch v := value.(type) {
 		case string:
-			v := value.(string)
-			next = self.expandString(term, v)
+			self.expandString(buf, term, v)
 		case []interface{}:
-			v := value.([]interface{})
-			next = self.expandArray(term, v)
+			self.expandArray(buf, term, v)
 		case map[string]interface{}:
 			if term.truncate > 0 {
-				err = errors.New("cannot truncate a map expansion")
-				break
+				return errors.New("cannot truncate a map expansion")
 			}
-			v := value.(map[string]interface{})
-			next = self.expandMap(term, v)
+			self.expandMap(buf, term, v)
 		default:
-			v := fmt.Sprintf("%v", value)
-			next = self.expandString(term, v)
+			self.expandString(buf, term, fmt.Sprintf("%v", value))
 		}
-		if result != self.first {
-			result += self.sep
+	}
+	if buf.Len() == start+len(self.first) {
+		buf.Truncate(start)
+	}
+	return nil
+}
+
+// unexpand parses segment, the run of uri claimed for this expression
+// by Unexpand, and binds its terms into out. An empty segment means
+// none of this expression's variables were present in the uri.
+func (self *templatePart) unexpand(segment string, out map[string]interface{}) (err error) {
+	if segment == "" {
+		return nil
+	}
+	if self.first != "" {
+		if !strings.HasPrefix(segment, self.first) {
+			return fmt.Errorf("uritemplates: expected %q prefix in %q", self.first, segment)
 		}
-		result += next
+		segment = segment[len(self.first):]
 	}
-	if result == self.first {
-		result = ""
+	if segment == "" {
+		return nil
 	}
-	return result, err
+	tokens := strings.Split(segment, self.sep)
+	if self.named {
+		return self.unexpandNamed(tokens, out)
+	}
+	return self.unexpandPositional(tokens, out)
 }
 
-func(self *templatePart) buildRegexp() string {
-	if self.raw != "" {
-		return regexp.QuoteMeta(self.raw)
-	}
-	restr := regexp.QuoteMeta(self.first)
-	varspecs := make([]string, len(self.terms), len(self.terms))
-	for idx, t := range self.terms {
-		group := ""
-		if self.allowReserved {
-			group = RESERVED_RE + "*?"
+// unexpandNamed binds the terms of a ";", "?" or "&" expression, whose
+// tokens look like "name" or "name=value". Tokens are matched to
+// declared terms by name rather than by position, so they may appear
+// in any order; any non-exploded term matched more than once is an
+// ambiguous match and reported as an error. Tokens whose key names no
+// declared term are collected into a map for the single exploded term
+// (if any) that itself matched no token by name, modeling a map
+// variable passed to that term at expansion time.
+func (self *templatePart) unexpandNamed(tokens []string, out map[string]interface{}) error {
+	type pair struct{ key, value string }
+	pairs := make([]pair, 0, len(tokens))
+	for _, tok := range tokens {
+		if tok == "" {
+			continue
+		}
+		if eq := strings.Index(tok, "="); eq >= 0 {
+			rawValue := tok[eq+1:]
+			if !self.charsetRE.MatchString(rawValue) {
+				return fmt.Errorf("uritemplates: value %q is not valid for this operator", rawValue)
+			}
+			key, _ := url.QueryUnescape(tok[:eq])
+			value, _ := url.QueryUnescape(rawValue)
+			pairs = append(pairs, pair{key, value})
 		} else {
-			switch self.sep {
-			case "/": group = UNRESERVED_RE + "*?"
-			case ".": group = strings.Replace(UNRESERVED_RE, "\\.", "", -1) + "*?"
-			case ";": group = UNRESERVED_RE + "*=?" + UNRESERVED_RE + "*?"
-			case "?", "&": group = UNRESERVED_RE + "*=" + UNRESERVED_RE + "*?"
-			default: group = UNRESERVED_RE + "*?"
+			key, _ := url.QueryUnescape(tok)
+			pairs = append(pairs, pair{key, ""})
+		}
+	}
+	claimed := make([]bool, len(pairs))
+	for _, t := range self.terms {
+		var matched []int
+		for idx, p := range pairs {
+			if p.key == t.name {
+				matched = append(matched, idx)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if !t.explode {
+			if len(matched) > 1 {
+				return fmt.Errorf("uritemplates: ambiguous match: %q appears more than once", t.name)
+			}
+			idx := matched[0]
+			if t.truncate > 0 && len(pairs[idx].value) > t.truncate {
+				return fmt.Errorf("uritemplates: value for %q exceeds prefix length %d", t.name, t.truncate)
 			}
+			out[t.name] = pairs[idx].value
+			claimed[idx] = true
+			continue
+		}
+		values := make([]string, len(matched))
+		for i, idx := range matched {
+			values[i] = pairs[idx].value
+			claimed[idx] = true
+		}
+		out[t.name] = values
+	}
+	var mapTerm *templateTerm
+	for i := range self.terms {
+		t := &self.terms[i]
+		if !t.explode {
+			continue
+		}
+		if _, bound := out[t.name]; bound {
+			continue
 		}
+		if mapTerm != nil {
+			return errors.New("uritemplates: ambiguous match: more than one exploded term could bind the remaining values")
+		}
+		mapTerm = t
+	}
+	if mapTerm == nil {
+		return nil
+	}
+	hash := make(map[string]string)
+	for idx, p := range pairs {
+		if claimed[idx] {
+			continue
+		}
+		hash[p.key] = p.value
+	}
+	if len(hash) > 0 {
+		out[mapTerm.name] = hash
+	}
+	return nil
+}
+
+// unexpandPositional binds the terms of a simple, "+", ".", "/" or "#"
+// expression, whose tokens carry no name and so must be matched to
+// declared terms by position. At most one term in the expression may
+// be exploded; it consumes as many leading tokens as are left over
+// once every other term has claimed its one token.
+func (self *templatePart) unexpandPositional(tokens []string, out map[string]interface{}) error {
+	if len(tokens) == 1 && tokens[0] == "" {
+		return nil
+	}
+	explodeAt := -1
+	for i, t := range self.terms {
 		if t.explode {
-			group = "(" + group + "(?:" + regexp.QuoteMeta(self.sep) + "?" + group + ")*)?"
-		} else {
-			group = "(" + group + ")?"
+			if explodeAt >= 0 {
+				return errors.New("uritemplates: ambiguous match: more than one exploded term in the same expression")
+			}
+			explodeAt = i
 		}
-		varspecs[idx] = group
 	}
-	return restr + strings.Join(varspecs, regexp.QuoteMeta(self.sep))
+	ti, pi := 0, 0
+	for pi < len(tokens) {
+		if ti >= len(self.terms) {
+			return errors.New("uritemplates: more values than declared terms")
+		}
+		t := self.terms[ti]
+		if !self.charsetRE.MatchString(tokens[pi]) {
+			return fmt.Errorf("uritemplates: value %q is not valid for this operator", tokens[pi])
+		}
+		if ti == explodeAt {
+			remainingTerms := len(self.terms) - ti - 1
+			take := len(tokens) - pi - remainingTerms
+			if take < 1 {
+				return errors.New("uritemplates: not enough values for the remaining terms")
+			}
+			for _, tok := range tokens[pi+1 : pi+take] {
+				if !self.charsetRE.MatchString(tok) {
+					return fmt.Errorf("uritemplates: value %q is not valid for this operator", tok)
+				}
+			}
+			out[t.name] = unescapeArr(tokens[pi : pi+take])
+			pi += take
+			ti++
+			continue
+		}
+		value, err := url.QueryUnescape(tokens[pi])
+		if err != nil {
+			return err
+		}
+		if t.truncate > 0 && len(value) > t.truncate {
+			return fmt.Errorf("uritemplates: value for %q exceeds prefix length %d", t.name, t.truncate)
+		}
+		out[t.name] = value
+		pi++
+		ti++
+	}
+	return nil
 }
 
 func (self *templatePart) expandName(name string, empty bool) (result string) {
@@ -360,28 +613,28 @@ func (self *templatePart) expandName(name string, empty bool) (result string) {
 	return result
 }
 
-func (self *templatePart) expandString(t templateTerm, s string) (result string) {
+func (self *templatePart) expandString(buf *bytes.Buffer, t templateTerm, s string) {
 	if len(s) > t.truncate && t.truncate > 0 {
 		s = s[:t.truncate]
 	}
-	return self.expandName(t.name, len(s) == 0) +
-		escape(s, self.allowReserved)
+	buf.WriteString(self.expandName(t.name, len(s) == 0))
+	buf.WriteString(escape(s, self.allowReserved))
 }
 
-func (self *templatePart) expandArray(t templateTerm, a []interface{}) (result string) {
+func (self *templatePart) expandArray(buf *bytes.Buffer, t templateTerm, a []interface{}) {
 	if !t.explode {
-		result = self.expandName(t.name, len(a) == 0)
+		buf.WriteString(self.expandName(t.name, len(a) == 0))
 	}
 	for i, v := range a {
 		if t.explode && i > 0 {
-			result += self.sep
+			buf.WriteString(self.sep)
 		} else if i > 0 {
-			result += ","
+			buf.WriteString(",")
 		}
 		var s string
-		switch v.(type) {
+		switch vv := v.(type) {
 		case string:
-			s = v.(string)
+			s = vv
 		default:
 			s = fmt.Sprintf("%v", v)
 		}
@@ -389,40 +642,42 @@ func (self *templatePart) expandArray(t templateTerm, a []interface{}) (result s
 			s = s[:t.truncate]
 		}
 		if self.named && t.explode {
-			result += self.expandName(t.name, len(s) == 0)
+			buf.WriteString(self.expandName(t.name, len(s) == 0))
 		}
-		result += escape(s, self.allowReserved)
+		buf.WriteString(escape(s, self.allowReserved))
 	}
-	return result
 }
 
-func (self *templatePart) expandMap(t templateTerm, m map[string]interface{}) (result string) {
+func (self *templatePart) expandMap(buf *bytes.Buffer, t templateTerm, m map[string]interface{}) {
+	if !t.explode {
+		buf.WriteString(self.expandName(t.name, len(m) == 0))
+	}
+	first := true
 	for k, v := range m {
-		if t.explode && len(result) > 0 {
-			result += self.sep
-		} else if len(result) > 0 {
-			result += ","
+		if !first {
+			if t.explode {
+				buf.WriteString(self.sep)
+			} else {
+				buf.WriteString(",")
+			}
 		}
+		first = false
 		var s string
-		switch v.(type) {
+		switch vv := v.(type) {
 		case string:
-			s = v.(string)
+			s = vv
 		default:
 			s = fmt.Sprintf("%v", v)
 		}
 		if len(s) > t.truncate && t.truncate > 0 {
 			s = s[:t.truncate]
 		}
+		buf.WriteString(escape(k, self.allowReserved))
 		if t.explode {
-			result += escape(k, self.allowReserved) +
-				"=" + escape(s, self.allowReserved)
+			buf.WriteString("=")
 		} else {
-			result += escape(k, self.allowReserved) +
-				"," + escape(s, self.allowReserved)
+			buf.WriteString(",")
 		}
+		buf.WriteString(escape(s, self.allowReserved))
 	}
-	if !t.explode {
-		result = self.expandName(t.name, len(m) == 0) + result
-	}
-	return result
 }
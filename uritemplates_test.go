@@ -5,6 +5,7 @@
 package uritemplates
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -121,33 +122,107 @@ func TestSpecExamples(t *testing.T) {
 }
 
 func testUx(template string, uri string) (map[string]interface{}, error) {
-	tmp, _ := Parse(template)
+	tmp, err := Parse(template)
+	if err != nil {
+		return nil, err
+	}
 	return tmp.Unexpand(uri)
 }
 
-func TestString(t *testing.T) {
-	res, _ := testUx("start~{contentType}", "start~vod")
-	fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("/a{/path*}{?events*}", "/a/b/c/d?123=start~one&342=asd")
-	fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("{;list*}", ";list=red;list=green;list=blue")
-	fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("{;list*}", ";a=red;b=green;c=blue")
-	fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("{;x,y,empty}", ";x=10;y=34;empty")
-	fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("{;x,y,undef}", ";x=10;y=34")
-	fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("X{.list}", "X.a,b,c")
-	fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("X{.list*}", "X.a.b.c")
-	fmt.Printf("%+v\n\n", res)
-	// res, _ = testUx("X{.x,y}", "X.1024.768")
-	// fmt.Printf("%+v\n\n", res)
-	// res, _ = testUx("?fixed=yes{&x}", "?fixed=yes&x=1024")
-	// fmt.Printf("%+v\n\n", res)
-	res, _ = testUx("{path*}Taa", "a,cb,cTaa")
-	fmt.Printf("map: %+v\n\n", res)
+func mapsEqual(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok {
+			return false
+		}
+		if fmt.Sprintf("%+v", av) != fmt.Sprintf("%+v", bv) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUnexpand(t *testing.T) {
+	cases := []struct {
+		template string
+		uri      string
+		expected map[string]interface{}
+	}{
+		{"start~{contentType}", "start~vod",
+			map[string]interface{}{"contentType": "vod"}},
+		{"/a{/path*}{?events*}", "/a/b/c/d?123=start~one&342=asd",
+			map[string]interface{}{
+				"path":   []string{"b", "c", "d"},
+				"events": map[string]string{"123": "start~one", "342": "asd"},
+			}},
+		{"{;list*}", ";list=red;list=green;list=blue",
+			map[string]interface{}{"list": []string{"red", "green", "blue"}}},
+		{"{;list*}", ";a=red;b=green;c=blue",
+			map[string]interface{}{"list": map[string]string{"a": "red", "b": "green", "c": "blue"}}},
+		{"{;x,y,empty}", ";x=10;y=34;empty",
+			map[string]interface{}{"x": "10", "y": "34", "empty": ""}},
+		{"{;x,y,undef}", ";x=10;y=34",
+			map[string]interface{}{"x": "10", "y": "34"}},
+		{"X{.list*}", "X.a.b.c",
+			map[string]interface{}{"list": []string{"a", "b", "c"}}},
+		// previously commented out: buildRegexp used to collapse
+		// multi-variable operators into a single repeated group.
+		{"X{.x,y}", "X.1024.768",
+			map[string]interface{}{"x": "1024", "y": "768"}},
+		{"?fixed=yes{&x}", "?fixed=yes&x=1024",
+			map[string]interface{}{"x": "1024"}},
+		{"{path*}Taa", "a,cb,cTaa",
+			map[string]interface{}{"path": []string{"a", "cb", "c"}}},
+		// named-operator pairs may appear in any order in the uri.
+		{"{?a,b}", "?b=2&a=1",
+			map[string]interface{}{"a": "1", "b": "2"}},
+		// {+path} allows reserved characters such as "/".
+		{"{+path}", "foo/bar",
+			map[string]interface{}{"path": "foo/bar"}},
+		// the reserved characters {+path} may contain must not be
+		// mistaken for the boundary of the adjacent {.ext} expression.
+		{"{+path}{.ext}", "/a.b/c.json",
+			map[string]interface{}{"path": "/a.b/c", "ext": "json"}},
+		// adjacent expressions sharing the same operator have no text
+		// boundary between them at all; they must be split by term
+		// count rather than by searching for one.
+		{"/repos{/owner}{/repo,ref}", "/repos/jtacoma/uritemplates/main",
+			map[string]interface{}{"owner": "jtacoma", "repo": "uritemplates", "ref": "main"}},
+		{"{;x}{;y,z}", ";x=a;y=b;z=c",
+			map[string]interface{}{"x": "a", "y": "b", "z": "c"}},
+	}
+	for _, c := range cases {
+		result, err := testUx(c.template, c.uri)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %s", c.template, c.uri, err)
+			continue
+		}
+		if !mapsEqual(result, c.expected) {
+			t.Errorf("%s %s: expected %+v, but got %+v", c.template, c.uri, c.expected, result)
+		}
+	}
+}
+
+func TestUnexpandRejectsAmbiguousOrInvalid(t *testing.T) {
+	cases := []struct {
+		template string
+		uri      string
+	}{
+		// "a" bound twice to the same non-exploded term.
+		{"{?a,b}", "?a=1&a=2"},
+		// {var} does not allow reserved characters such as "/".
+		{"{path}", "foo/bar"},
+		// {?path} is unreserved-only too, same as {var}.
+		{"{?path}", "?path=foo/bar"},
+	}
+	for _, c := range cases {
+		if _, err := testUx(c.template, c.uri); err == nil {
+			t.Errorf("%s %s: expected an error, but Unexpand succeeded", c.template, c.uri)
+		}
+	}
 }
 
 func BenchmarkParse(b *testing.B) {
@@ -170,3 +245,48 @@ func BenchmarkExpand(b *testing.B) {
 		templ.Expand(data)
 	}
 }
+
+func TestExpandTo(t *testing.T) {
+	templ, err := Parse("/repos{/owner,repo}{?q*}")
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	values := map[string]interface{}{
+		"owner": "jtacoma",
+		"repo":  "uritemplates",
+		"q":     map[string]interface{}{"sort": "stars"},
+	}
+	var buf bytes.Buffer
+	n, err := templ.ExpandTo(&buf, values)
+	if err != nil {
+		t.Fatalf("ExpandTo failed: %s", err)
+	}
+	expected, err := templ.Expand(values)
+	if err != nil {
+		t.Fatalf("Expand failed: %s", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected %v, but got %v", expected, buf.String())
+	}
+	if n != int64(len(expected)) {
+		t.Errorf("expected %d bytes written, but got %d", len(expected), n)
+	}
+}
+
+// BenchmarkExpandManyQueryParams exercises the O(n^2)-prone path: a
+// single {?q*} exploded over a large map, which used to dominate
+// BenchmarkExpand before expand/expandString/expandArray/expandMap
+// were switched from string concatenation to writing into a shared
+// *bytes.Buffer.
+func BenchmarkExpandManyQueryParams(b *testing.B) {
+	templ, _ := Parse("http://localhost:6060/search{?q*}")
+	q := make(map[string]interface{}, 1000)
+	for i := 0; i < 1000; i++ {
+		q[fmt.Sprintf("param%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	data := map[string]interface{}{"q": q}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		templ.Expand(data)
+	}
+}